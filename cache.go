@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 环境变量键：缓存配置
+const (
+	HA_CACHE_TTL_STATE_KEY   = "HA_CACHE_TTL_STATE"
+	HA_CACHE_TTL_LIST_KEY    = "HA_CACHE_TTL_LIST"
+	HA_CACHE_MAX_ENTRIES_KEY = "HA_CACHE_MAX_ENTRIES"
+)
+
+// 默认缓存参数
+const (
+	defaultCacheTTLState   = 5 * time.Second
+	defaultCacheTTLList    = 30 * time.Second
+	defaultCacheMaxEntries = 1000
+)
+
+// cacheEntry 是缓存中的一条记录：已解析的响应体 + 过期时间
+type cacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// ResponseCache 是一个按 URL 键控的内存缓存，支持 TTL 过期以及按 entity_id 的主动失效
+type ResponseCache struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	maxEntries int
+
+	hits, misses, evictions int64
+}
+
+// NewResponseCache 创建一个缓存，maxEntries <= 0 表示不限制条目数
+func NewResponseCache(maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		entries:    make(map[string]cacheEntry),
+		maxEntries: maxEntries,
+	}
+}
+
+// Get 返回 key 对应的缓存值；未命中或已过期都视为 miss
+func (c *ResponseCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		if ok {
+			delete(c.entries, key)
+		}
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.value, true
+}
+
+// Set 写入一条缓存，TTL <= 0 时不缓存
+func (c *ResponseCache) Set(key string, value interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		// 简单的驱逐策略：挑一条过期时间最早的记录腾位置
+		var oldestKey string
+		var oldestAt time.Time
+		for k, e := range c.entries {
+			if oldestKey == "" || e.expiresAt.Before(oldestAt) {
+				oldestKey, oldestAt = k, e.expiresAt
+			}
+		}
+		if oldestKey != "" {
+			delete(c.entries, oldestKey)
+			c.evictions++
+		}
+	}
+
+	c.entries[key] = cacheEntry{value: value, expiresAt: time.Now().Add(ttl)}
+}
+
+// InvalidateEntity 清除某个实例下、键中包含该 entity_id 的缓存条目，以及该实例的
+// list_entities 结果（其中很可能包含了该实体，因此也需要一并失效）
+func (c *ResponseCache) InvalidateEntity(instance, entityID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	listKey := "list_entities:" + instance
+	for k := range c.entries {
+		if !strings.HasPrefix(k, "get_state:"+instance+":") && k != listKey {
+			continue
+		}
+		if k == listKey || strings.HasSuffix(k, ":"+entityID) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// CacheStats 是 cache_stats 工具返回的快照
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Size      int   `json:"size"`
+	Evictions int64 `json:"evictions"`
+}
+
+func (c *ResponseCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Size:      len(c.entries),
+		Evictions: c.evictions,
+	}
+}
+
+// durationFromEnv 读取一个以秒为单位的环境变量，解析失败或未设置时返回 fallback
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds < 0 {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// intFromEnv 读取一个整数环境变量，解析失败或未设置时返回 fallback
+func intFromEnv(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// 环境变量键：配置文件路径
+const HA_CONFIG_FILE_KEY = "HA_CONFIG_FILE"
+
+// InstanceConfig 描述 TOML 配置文件中的一个 [[instance]] 块
+type InstanceConfig struct {
+	Name               string `toml:"name"`
+	URL                string `toml:"url"`
+	Token              string `toml:"token"`
+	TokenFile          string `toml:"token_file"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	CAFile             string `toml:"ca_file"`
+}
+
+// fileConfig 对应 TOML 配置文件的顶层结构
+type fileConfig struct {
+	Instances []InstanceConfig `toml:"instance"`
+	Policy    PolicyConfig     `toml:"policy"`
+}
+
+// Config 是合并后的最终运行配置：--config 参数优先于 HA_CONFIG_FILE 环境变量；
+// 实例取自 TOML 文件，HA_URL/HA_TOKEN 只在文件未定义任何实例时使用，
+// 不会覆盖文件中已定义的实例
+type Config struct {
+	Instances []InstanceConfig
+	Policy    PolicyConfig
+	Transport string
+	Listen    string
+}
+
+// LoadConfig 解析命令行参数并在提供 --config 时叠加 TOML 文件中的实例定义。
+// 没有任何实例配置时，退回到原先的 HA_URL/HA_TOKEN 单实例模式以保持兼容。
+func LoadConfig() (*Config, error) {
+	transportFlag := flag.String("transport", "stdio", "传输方式：stdio 或 http")
+	listenFlag := flag.String("listen", ":8765", "--transport=http 时监听的地址")
+	configFlag := flag.String("config", os.Getenv(HA_CONFIG_FILE_KEY), "TOML 配置文件路径，例如 /etc/ha-mcp.toml")
+	flag.Parse()
+
+	cfg := &Config{Transport: *transportFlag, Listen: *listenFlag}
+
+	if *configFlag != "" {
+		var file fileConfig
+		if _, err := toml.DecodeFile(*configFlag, &file); err != nil {
+			return nil, fmt.Errorf("读取配置文件 %s 失败: %w", *configFlag, err)
+		}
+		cfg.Instances = file.Instances
+		cfg.Policy = file.Policy
+	}
+
+	if len(cfg.Instances) == 0 {
+		haURL := os.Getenv(HA_URL_KEY)
+		if haURL == "" {
+			haURL = DEFAULT_HA_URL
+		}
+		cfg.Instances = []InstanceConfig{{
+			Name:  "default",
+			URL:   haURL,
+			Token: os.Getenv(HA_TOKEN_KEY),
+		}}
+	}
+
+	for i := range cfg.Instances {
+		inst := &cfg.Instances[i]
+		if inst.Name == "" {
+			inst.Name = fmt.Sprintf("instance-%d", i)
+		}
+		if inst.Token == "" && inst.TokenFile != "" {
+			token, err := os.ReadFile(inst.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("读取 token_file %s 失败: %w", inst.TokenFile, err)
+			}
+			inst.Token = strings.TrimSpace(string(token))
+		}
+		if inst.Token == "" {
+			return nil, fmt.Errorf("实例 %q 缺少 token（需配置 token 或 token_file）", inst.Name)
+		}
+		if inst.URL == "" {
+			return nil, fmt.Errorf("实例 %q 缺少 url", inst.Name)
+		}
+	}
+
+	return cfg, nil
+}
+
+// HAInstance 是建立好连接配置的单个 Home Assistant 实例：所有出站 HTTP 请求
+// 都通过 BaseURL/Token/Client 完成，BaseURL 已经把 unix:// 形式重写成了
+// 一个可以拼接 /api/... 路径的 http(s) 地址。EventHub 的 websocket 连接只用到
+// BaseURL/Token，由 websocket 默认 Dialer 建立，不使用 Client 的 TLS 与 unix socket 设置。
+type HAInstance struct {
+	Name    string
+	BaseURL string
+	Token   string
+	Client  *http.Client
+}
+
+// NewHAInstance 依据实例配置构建 http.Client：支持自签名证书
+// （insecure_skip_verify）、自定义 CA（ca_file）以及 HA add-on 场景下常见的
+// unix socket 部署（url = "unix:///path/to.sock"）。
+func NewHAInstance(cfg InstanceConfig) (*HAInstance, error) {
+	transport := &http.Transport{}
+	baseURL := cfg.URL
+
+	if strings.HasPrefix(cfg.URL, "unix://") {
+		socketPath := strings.TrimPrefix(cfg.URL, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		}
+		baseURL = "http://unix"
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("读取 ca_file %s 失败: %w", cfg.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s 不包含有效的 PEM 证书", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &HAInstance{
+		Name:    cfg.Name,
+		BaseURL: baseURL,
+		Token:   cfg.Token,
+		Client:  &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}, nil
+}
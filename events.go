@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 环形缓冲区大小：当 stdout 消费者跟不上时，旧事件会被丢弃而不是阻塞/OOM
+const eventBufferSize = 256
+
+// internalStateSubID 是驱动缓存失效的内部 state_changed 订阅的固定 ID，
+// 不会出现在 h.subscriptions 中，也不会被当作客户端订阅投递
+const internalStateSubID = "__internal_state_changed__"
+
+// EventSubscription 描述一次订阅
+type EventSubscription struct {
+	ID         string `json:"subscription_id"`
+	EventType  string `json:"event_type"`  // 为空表示 state_changed
+	EntityGlob string `json:"entity_glob"` // 为空表示不按 entity_id 过滤
+}
+
+// haEvent 对应 HA 通过 websocket 推送的 type 为 "event" 的消息
+type haEvent struct {
+	ID    int64  `json:"id"`
+	Type  string `json:"type"`
+	Event struct {
+		EventType string          `json:"event_type"`
+		Data      json.RawMessage `json:"data"`
+	} `json:"event"`
+}
+
+// EventHub 维护到 HA /api/websocket 的长连接，自动重连，并把事件广播给订阅者
+type EventHub struct {
+	haURL   string
+	haToken string
+
+	// onEvent 在匹配的事件到达时被调用；由 HomeAssistantServer 注入，
+	// 用于把事件包装成 MCP "notification" 经 transport 推送给拥有该订阅的会话
+	onEvent func(subscriptionID string, event interface{})
+
+	// onStateChanged 在每个 state_changed 事件到达时都会被调用（不受订阅过滤影响），
+	// 供缓存层据此做主动失效
+	onStateChanged func(entityID string)
+
+	mu            sync.Mutex
+	subscriptions map[string]EventSubscription
+	haSubIDBySub  map[string]int64 // 我们的 subscription_id -> HA 端的 subscribe_events 请求 id
+
+	nextMsgID int64
+
+	buffer chan func() // 有界队列，串行消费，超出则丢弃最旧的一项
+
+	closeCh chan struct{}
+	closed  int32
+}
+
+// NewEventHub 创建事件订阅子系统，但不会立即连接；调用 Run 建立连接
+func NewEventHub(haURL, haToken string) *EventHub {
+	return &EventHub{
+		haURL:         haURL,
+		haToken:       haToken,
+		subscriptions: make(map[string]EventSubscription),
+		haSubIDBySub:  make(map[string]int64),
+		buffer:        make(chan func(), eventBufferSize),
+		closeCh:       make(chan struct{}),
+		nextMsgID:     1,
+	}
+}
+
+// SetOnEvent 注册事件回调
+func (h *EventHub) SetOnEvent(fn func(subscriptionID string, event interface{})) {
+	h.mu.Lock()
+	h.onEvent = fn
+	h.mu.Unlock()
+}
+
+// SetOnStateChanged 注册 state_changed 回调，用于驱动缓存失效
+func (h *EventHub) SetOnStateChanged(fn func(entityID string)) {
+	h.mu.Lock()
+	h.onStateChanged = fn
+	h.mu.Unlock()
+}
+
+// Run 以指数退避的方式保持连接，直到 Close 被调用
+func (h *EventHub) Run() {
+	go h.drainLoop()
+
+	backoff := time.Second
+	const maxBackoff = 60 * time.Second
+	for {
+		select {
+		case <-h.closeCh:
+			return
+		default:
+		}
+
+		if err := h.connectOnce(); err != nil {
+			log.Printf("websocket 连接断开: %v，%s 后重试", err, backoff)
+		}
+
+		select {
+		case <-h.closeCh:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Close 停止重连循环并释放资源
+func (h *EventHub) Close() {
+	if atomic.CompareAndSwapInt32(&h.closed, 0, 1) {
+		close(h.closeCh)
+	}
+}
+
+// wsURL 把 http(s)://host 形式的 HAURL 转换成 ws(s)://host/api/websocket
+func (h *EventHub) wsURL() string {
+	u := strings.TrimRight(h.haURL, "/")
+	u = strings.Replace(u, "https://", "wss://", 1)
+	u = strings.Replace(u, "http://", "ws://", 1)
+	return u + "/api/websocket"
+}
+
+func (h *EventHub) connectOnce() error {
+	conn, _, err := websocket.DefaultDialer.Dial(h.wsURL(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// HA 握手：服务器先发 auth_required，客户端回 auth，服务器回 auth_ok/auth_invalid
+	var hello struct {
+		Type string `json:"type"`
+	}
+	if err := conn.ReadJSON(&hello); err != nil {
+		return err
+	}
+	if hello.Type != "auth_required" {
+		return fmt.Errorf("意外的握手消息: %s", hello.Type)
+	}
+	if err := conn.WriteJSON(map[string]string{
+		"type":         "auth",
+		"access_token": h.haToken,
+	}); err != nil {
+		return err
+	}
+	var authResp struct {
+		Type string `json:"type"`
+	}
+	if err := conn.ReadJSON(&authResp); err != nil {
+		return err
+	}
+	if authResp.Type != "auth_ok" {
+		return fmt.Errorf("HA 鉴权失败: %s", authResp.Type)
+	}
+
+	// 无论是否有客户端通过 subscribe_events 订阅，都要保持对 state_changed 的
+	// 订阅，否则 HA 不会推送任何事件，onStateChanged（驱动缓存主动失效）永远
+	// 不会被触发，缓存退化为纯 TTL 过期。这个订阅只用于驱动 HA 推流，不出现在
+	// h.subscriptions 里，因此也不会被当成客户端订阅投递给 onEvent。
+	if err := h.sendSubscribe(conn, EventSubscription{ID: internalStateSubID, EventType: "state_changed"}); err != nil {
+		return err
+	}
+
+	// 重新发送当前所有订阅（重连后 HA 端的旧订阅已失效）
+	h.mu.Lock()
+	subs := make([]EventSubscription, 0, len(h.subscriptions))
+	for _, sub := range h.subscriptions {
+		subs = append(subs, sub)
+	}
+	h.mu.Unlock()
+	for _, sub := range subs {
+		if err := h.sendSubscribe(conn, sub); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var msg haEvent
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		if msg.Type != "event" {
+			continue
+		}
+		h.dispatch(msg)
+	}
+}
+
+func (h *EventHub) sendSubscribe(conn *websocket.Conn, sub EventSubscription) error {
+	id := atomic.AddInt64(&h.nextMsgID, 1)
+	req := map[string]interface{}{
+		"id":   id,
+		"type": "subscribe_events",
+	}
+	if sub.EventType != "" {
+		req["event_type"] = sub.EventType
+	}
+	if err := conn.WriteJSON(req); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.haSubIDBySub[sub.ID] = id
+	h.mu.Unlock()
+	return nil
+}
+
+// dispatch 按 entity_id glob 过滤后，把事件投递到有界缓冲区
+func (h *EventHub) dispatch(msg haEvent) {
+	var data struct {
+		EntityID string `json:"entity_id"`
+	}
+	_ = json.Unmarshal(msg.Event.Data, &data)
+
+	h.mu.Lock()
+	matches := make([]EventSubscription, 0, 1)
+	for _, sub := range h.subscriptions {
+		if sub.EventType != "" && sub.EventType != msg.Event.EventType {
+			continue
+		}
+		if sub.EntityGlob != "" && data.EntityID != "" {
+			ok, err := path.Match(sub.EntityGlob, data.EntityID)
+			if err != nil || !ok {
+				continue
+			}
+		}
+		matches = append(matches, sub)
+	}
+	onEvent := h.onEvent
+	onStateChanged := h.onStateChanged
+	h.mu.Unlock()
+
+	if onStateChanged != nil && msg.Event.EventType == "state_changed" && data.EntityID != "" {
+		entityID := data.EntityID
+		h.enqueue(func() { onStateChanged(entityID) })
+	}
+
+	if onEvent == nil {
+		return
+	}
+	for _, sub := range matches {
+		sub := sub
+		var event interface{}
+		_ = json.Unmarshal(msg.Event.Data, &event)
+		payload := map[string]interface{}{
+			"event_type": msg.Event.EventType,
+			"data":       event,
+		}
+		h.enqueue(func() { onEvent(sub.ID, payload) })
+	}
+}
+
+// enqueue 把回调放进有界缓冲区；满了就丢弃最旧的一个，保证生产者不会阻塞
+func (h *EventHub) enqueue(fn func()) {
+	select {
+	case h.buffer <- fn:
+	default:
+		select {
+		case <-h.buffer:
+		default:
+		}
+		select {
+		case h.buffer <- fn:
+		default:
+		}
+	}
+}
+
+func (h *EventHub) drainLoop() {
+	for {
+		select {
+		case <-h.closeCh:
+			return
+		case fn := <-h.buffer:
+			fn()
+		}
+	}
+}
+
+// Subscribe 注册一个新订阅，返回生成的 subscription_id
+func (h *EventHub) Subscribe(eventType, entityGlob string) string {
+	if eventType == "" {
+		eventType = "state_changed"
+	}
+	id := strconv.FormatInt(rand.Int63(), 36)
+	sub := EventSubscription{ID: id, EventType: eventType, EntityGlob: entityGlob}
+	h.mu.Lock()
+	h.subscriptions[id] = sub
+	h.mu.Unlock()
+	return id
+}
+
+// Unsubscribe 移除一个订阅；返回是否存在过该订阅
+func (h *EventHub) Unsubscribe(id string) bool {
+	h.mu.Lock()
+	_, ok := h.subscriptions[id]
+	delete(h.subscriptions, id)
+	delete(h.haSubIDBySub, id)
+	h.mu.Unlock()
+	return ok
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -38,9 +39,11 @@ type MCPRequest struct {
 
 // MCP 响应结构
 type MCPResponse struct {
-	Type    string      `json:"type"`
-	Content interface{} `json:"content,omitempty"`
-	Error   *MCPError   `json:"error,omitempty"`
+	Type           string      `json:"type"`
+	Content        interface{} `json:"content,omitempty"`
+	Error          *MCPError   `json:"error,omitempty"`
+	SubscriptionID string      `json:"subscription_id,omitempty"` // 仅 Type == "notification" 时使用
+	Event          interface{} `json:"event,omitempty"`           // 仅 Type == "notification" 时使用
 }
 
 // 工具描述结构
@@ -56,24 +59,84 @@ type MCPError struct {
 	Message string `json:"message"`
 }
 
+// subOwnerEntry 记录一个事件订阅属于哪个会话、挂在哪个 HA 实例的 EventHub 上
+type subOwnerEntry struct {
+	sessionID string
+	instance  string
+}
+
 type HomeAssistantServer struct {
-	HAURL    string
-	HAToken  string
-	Client   *http.Client
+	Instances       map[string]*HAInstance
+	DefaultInstance string
+
 	Tools    []Tool
 	ExitChan chan os.Signal
+
+	wsHubs    map[string]*EventHub // instance name -> 该实例的事件订阅子系统
+	transport Transport
+
+	policy *Policy // 为 nil 时表示未配置 [policy]，所有调用直接放行
+
+	subOwnerMu sync.RWMutex
+	subOwner   map[string]subOwnerEntry // subscription_id -> 拥有它的会话与所属实例
+
+	cache         *ResponseCache
+	cacheTTLState time.Duration
+	cacheTTLList  time.Duration
 }
 
-func NewHomeAssistantServer(haURL, haToken string) *HomeAssistantServer {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// NewHomeAssistantServer 依据已解析的配置构建服务器，为每个 [[instance]] 建立
+// 各自的 http.Client（TLS/unix socket 均在 NewHAInstance 中处理）
+func NewHomeAssistantServer(cfg *Config) (*HomeAssistantServer, error) {
+	instances := make(map[string]*HAInstance, len(cfg.Instances))
+	for _, instCfg := range cfg.Instances {
+		inst, err := NewHAInstance(instCfg)
+		if err != nil {
+			return nil, err
+		}
+		instances[inst.Name] = inst
+	}
+
+	var policy *Policy
+	if hasPolicy(cfg.Policy) {
+		var err error
+		policy, err = NewPolicy(cfg.Policy)
+		if err != nil {
+			return nil, err
+		}
 	}
+
 	return &HomeAssistantServer{
-		HAURL:    haURL,
-		HAToken:  haToken,
-		Client:   client,
-		ExitChan: make(chan os.Signal, 1),
+		Instances:       instances,
+		DefaultInstance: cfg.Instances[0].Name,
+		ExitChan:        make(chan os.Signal, 1),
+		subOwner:        make(map[string]subOwnerEntry),
+		policy:          policy,
+		cache:           NewResponseCache(intFromEnv(HA_CACHE_MAX_ENTRIES_KEY, defaultCacheMaxEntries)),
+		cacheTTLState:   durationFromEnv(HA_CACHE_TTL_STATE_KEY, defaultCacheTTLState),
+		cacheTTLList:    durationFromEnv(HA_CACHE_TTL_LIST_KEY, defaultCacheTTLList),
+	}, nil
+}
+
+// hasPolicy 判断 [policy] 是否被实际配置过（TOML 里完全省略该块时 Policy 字段为零值）
+func hasPolicy(cfg PolicyConfig) bool {
+	return len(cfg.AllowTools) > 0 || len(cfg.DenyTools) > 0 ||
+		len(cfg.AllowEntities) > 0 || len(cfg.DenyEntities) > 0 ||
+		len(cfg.RequireConfirmation) > 0 || cfg.AuditLog != ""
+}
+
+// resolveInstance 根据工具参数中可选的 instance 字段选择目标 HA 实例，
+// 缺省时使用配置中的第一个实例
+func (s *HomeAssistantServer) resolveInstance(args map[string]interface{}) (*HAInstance, *MCPError) {
+	name, _ := args["instance"].(string)
+	if name == "" {
+		name = s.DefaultInstance
+	}
+	inst, ok := s.Instances[name]
+	if !ok {
+		return nil, &MCPError{Code: "InvalidParams", Message: fmt.Sprintf("未知的 HA 实例: %s", name)}
 	}
+	return inst, nil
 }
 
 func (s *HomeAssistantServer) InitializeTools() {
@@ -88,6 +151,10 @@ func (s *HomeAssistantServer) InitializeTools() {
 						"type":        "string",
 						"description": "要获取状态的实体 ID（例如：light.living_room）",
 					},
+					"instance": map[string]interface{}{
+						"type":        "string",
+						"description": "要操作的 HA 实例名称，缺省为配置中的第一个实例",
+					},
 				},
 				"required": []string{"entity_id"},
 			},
@@ -107,6 +174,10 @@ func (s *HomeAssistantServer) InitializeTools() {
 						"description": "期望的状态（on/off）",
 						"enum":        []string{"on", "off"},
 					},
+					"instance": map[string]interface{}{
+						"type":        "string",
+						"description": "要操作的 HA 实例名称，缺省为配置中的第一个实例",
+					},
 				},
 				"required": []string{"entity_id", "state"},
 			},
@@ -121,6 +192,10 @@ func (s *HomeAssistantServer) InitializeTools() {
 						"type":        "string",
 						"description": "要触发的自动化 ID（例如：automation.morning_routine）",
 					},
+					"instance": map[string]interface{}{
+						"type":        "string",
+						"description": "要操作的 HA 实例名称，缺省为配置中的第一个实例",
+					},
 				},
 				"required": []string{"automation_id"},
 			},
@@ -135,9 +210,104 @@ func (s *HomeAssistantServer) InitializeTools() {
 						"type":        "string",
 						"description": "可选的领域过滤器（例如：light, switch, automation）",
 					},
+					"instance": map[string]interface{}{
+						"type":        "string",
+						"description": "要操作的 HA 实例名称，缺省为配置中的第一个实例",
+					},
 				},
 			},
 		},
+		{
+			Name:        "call_service",
+			Description: "调用 Home Assistant 的任意服务（例如 climate.set_temperature、notify.mobile_app、script.turn_on）",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"domain": map[string]interface{}{
+						"type":        "string",
+						"description": "服务所属的领域（例如：climate, media_player, notify, script, scene, cover）",
+					},
+					"service": map[string]interface{}{
+						"type":        "string",
+						"description": "要调用的服务名称（例如：set_temperature, turn_on）",
+					},
+					"service_data": map[string]interface{}{
+						"type":        "object",
+						"description": "传递给服务的额外参数（任意 JSON 对象）",
+					},
+					"target": map[string]interface{}{
+						"type":        "object",
+						"description": "服务的目标，可包含 entity_id、area_id、device_id",
+						"properties": map[string]interface{}{
+							"entity_id": map[string]interface{}{"type": "string"},
+							"area_id":   map[string]interface{}{"type": "string"},
+							"device_id": map[string]interface{}{"type": "string"},
+						},
+					},
+					"instance": map[string]interface{}{
+						"type":        "string",
+						"description": "要操作的 HA 实例名称，缺省为配置中的第一个实例",
+					},
+				},
+				"required": []string{"domain", "service"},
+			},
+		},
+		{
+			Name:        "list_services",
+			Description: "列出 Home Assistant 支持的所有领域及其服务",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"instance": map[string]interface{}{
+						"type":        "string",
+						"description": "要操作的 HA 实例名称，缺省为配置中的第一个实例",
+					},
+				},
+			},
+		},
+		{
+			Name:        "subscribe_events",
+			Description: "订阅 Home Assistant 的事件流，匹配的事件会以 MCP notification 的形式持续推送",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"event_type": map[string]interface{}{
+						"type":        "string",
+						"description": "要订阅的事件类型，留空表示 state_changed",
+					},
+					"entity_id_glob": map[string]interface{}{
+						"type":        "string",
+						"description": "按 entity_id 过滤的 glob 模式（例如 light.*），留空表示不过滤",
+					},
+					"instance": map[string]interface{}{
+						"type":        "string",
+						"description": "要订阅的 HA 实例名称，缺省为配置中的第一个实例",
+					},
+				},
+			},
+		},
+		{
+			Name:        "unsubscribe_events",
+			Description: "取消一个此前通过 subscribe_events 创建的事件订阅",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"subscription_id": map[string]interface{}{
+						"type":        "string",
+						"description": "subscribe_events 返回的订阅 ID",
+					},
+				},
+				"required": []string{"subscription_id"},
+			},
+		},
+		{
+			Name:        "cache_stats",
+			Description: "查看 get_state/list_entities 响应缓存的命中次数、未命中次数、大小与驱逐次数",
+			InputSchema: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+		},
 	}
 }
 
@@ -147,27 +317,39 @@ func (s *HomeAssistantServer) getEntityState(args map[string]interface{}) (inter
 		return nil, &MCPError{Code: "InvalidParams", Message: "entity_id 是必需的"}
 	}
 
-	url := fmt.Sprintf("%s/api/states/%s", strings.TrimRight(s.HAURL, "/"), entityID)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	inst, mcpErr := s.resolveInstance(args)
+	if mcpErr != nil {
+		return nil, mcpErr
 	}
-	req.Header.Set("Authorization", "Bearer "+s.HAToken)
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := s.Client.Do(req)
-	if err != nil {
-		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, &MCPError{Code: "HomeAssistantAPIError", Message: fmt.Sprintf("状态码: %d", resp.StatusCode)}
-	}
+	url := fmt.Sprintf("%s/api/states/%s", strings.TrimRight(inst.BaseURL, "/"), entityID)
+	cacheKey := fmt.Sprintf("get_state:%s:%s", inst.Name, entityID)
 
 	var data interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	if cached, ok := s.cache.Get(cacheKey); ok {
+		data = cached
+	} else {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+		}
+		req.Header.Set("Authorization", "Bearer "+inst.Token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := inst.Client.Do(req)
+		if err != nil {
+			return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, &MCPError{Code: "HomeAssistantAPIError", Message: fmt.Sprintf("状态码: %d", resp.StatusCode)}
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+		}
+		s.cache.Set(cacheKey, data, s.cacheTTLState)
 	}
 
 	return map[string]interface{}{
@@ -191,8 +373,13 @@ func (s *HomeAssistantServer) toggleEntity(args map[string]interface{}) (interfa
 		return nil, &MCPError{Code: "InvalidParams", Message: "state 必须为 'on' 或 'off'"}
 	}
 
+	inst, mcpErr := s.resolveInstance(args)
+	if mcpErr != nil {
+		return nil, mcpErr
+	}
+
 	service := "turn_" + state
-	url := fmt.Sprintf("%s/api/services/homeassistant/%s", strings.TrimRight(s.HAURL, "/"), service)
+	url := fmt.Sprintf("%s/api/services/homeassistant/%s", strings.TrimRight(inst.BaseURL, "/"), service)
 
 	payload := map[string]interface{}{
 		"entity_id": entityID,
@@ -206,10 +393,10 @@ func (s *HomeAssistantServer) toggleEntity(args map[string]interface{}) (interfa
 	if err != nil {
 		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
 	}
-	req.Header.Set("Authorization", "Bearer "+s.HAToken)
+	req.Header.Set("Authorization", "Bearer "+inst.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := s.Client.Do(req)
+	resp, err := inst.Client.Do(req)
 	if err != nil {
 		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
 	}
@@ -235,7 +422,12 @@ func (s *HomeAssistantServer) triggerAutomation(args map[string]interface{}) (in
 		return nil, &MCPError{Code: "InvalidParams", Message: "automation_id 是必需的"}
 	}
 
-	url := fmt.Sprintf("%s/api/services/automation/trigger", strings.TrimRight(s.HAURL, "/"))
+	inst, mcpErr := s.resolveInstance(args)
+	if mcpErr != nil {
+		return nil, mcpErr
+	}
+
+	url := fmt.Sprintf("%s/api/services/automation/trigger", strings.TrimRight(inst.BaseURL, "/"))
 
 	payload := map[string]interface{}{
 		"entity_id": automationID,
@@ -249,10 +441,10 @@ func (s *HomeAssistantServer) triggerAutomation(args map[string]interface{}) (in
 	if err != nil {
 		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
 	}
-	req.Header.Set("Authorization", "Bearer "+s.HAToken)
+	req.Header.Set("Authorization", "Bearer "+inst.Token)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := s.Client.Do(req)
+	resp, err := inst.Client.Do(req)
 	if err != nil {
 		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
 	}
@@ -273,28 +465,39 @@ func (s *HomeAssistantServer) triggerAutomation(args map[string]interface{}) (in
 }
 
 func (s *HomeAssistantServer) listEntities(args map[string]interface{}) (interface{}, *MCPError) {
-	url := fmt.Sprintf("%s/api/states", strings.TrimRight(s.HAURL, "/"))
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
-	}
-	req.Header.Set("Authorization", "Bearer "+s.HAToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := s.Client.Do(req)
-	if err != nil {
-		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	inst, mcpErr := s.resolveInstance(args)
+	if mcpErr != nil {
+		return nil, mcpErr
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, &MCPError{Code: "HomeAssistantAPIError", Message: fmt.Sprintf("状态码: %d", resp.StatusCode)}
-	}
+	url := fmt.Sprintf("%s/api/states", strings.TrimRight(inst.BaseURL, "/"))
+	cacheKey := "list_entities:" + inst.Name
 
 	var entities []map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&entities); err != nil {
-		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	if cached, ok := s.cache.Get(cacheKey); ok {
+		entities, _ = cached.([]map[string]interface{})
+	} else {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+		}
+		req.Header.Set("Authorization", "Bearer "+inst.Token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := inst.Client.Do(req)
+		if err != nil {
+			return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, &MCPError{Code: "HomeAssistantAPIError", Message: fmt.Sprintf("状态码: %d", resp.StatusCode)}
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&entities); err != nil {
+			return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+		}
+		s.cache.Set(cacheKey, entities, s.cacheTTLList)
 	}
 
 	// 如果提供了 domain 过滤
@@ -329,6 +532,198 @@ func (s *HomeAssistantServer) listEntities(args map[string]interface{}) (interfa
 	}, nil
 }
 
+func (s *HomeAssistantServer) callService(args map[string]interface{}) (interface{}, *MCPError) {
+	domain, ok := args["domain"].(string)
+	if !ok || domain == "" {
+		return nil, &MCPError{Code: "InvalidParams", Message: "domain 是必需的"}
+	}
+
+	service, ok := args["service"].(string)
+	if !ok || service == "" {
+		return nil, &MCPError{Code: "InvalidParams", Message: "service 是必需的"}
+	}
+
+	payload := map[string]interface{}{}
+	if serviceData, ok := args["service_data"].(map[string]interface{}); ok {
+		for k, v := range serviceData {
+			payload[k] = v
+		}
+	}
+	if target, ok := args["target"].(map[string]interface{}); ok {
+		for _, key := range []string{"entity_id", "area_id", "device_id"} {
+			if v, ok := target[key]; ok {
+				payload[key] = v
+			}
+		}
+	}
+
+	inst, mcpErr := s.resolveInstance(args)
+	if mcpErr != nil {
+		return nil, mcpErr
+	}
+
+	url := fmt.Sprintf("%s/api/services/%s/%s", strings.TrimRight(inst.BaseURL, "/"), domain, service)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	}
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	}
+	req.Header.Set("Authorization", "Bearer "+inst.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := inst.Client.Do(req)
+	if err != nil {
+		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &MCPError{Code: "HomeAssistantAPIError", Message: fmt.Sprintf("状态码: %d", resp.StatusCode)}
+	}
+
+	// HA 在成功时返回受该服务调用影响的状态变化数组
+	var changed []interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&changed); err != nil {
+		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	}
+
+	return map[string]interface{}{
+		"content": []interface{}{
+			map[string]interface{}{
+				"type": "text",
+				"text": toPrettyJSON(changed),
+			},
+		},
+	}, nil
+}
+
+func (s *HomeAssistantServer) listServices(args map[string]interface{}) (interface{}, *MCPError) {
+	inst, mcpErr := s.resolveInstance(args)
+	if mcpErr != nil {
+		return nil, mcpErr
+	}
+
+	url := fmt.Sprintf("%s/api/services", strings.TrimRight(inst.BaseURL, "/"))
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	}
+	req.Header.Set("Authorization", "Bearer "+inst.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := inst.Client.Do(req)
+	if err != nil {
+		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &MCPError{Code: "HomeAssistantAPIError", Message: fmt.Sprintf("状态码: %d", resp.StatusCode)}
+	}
+
+	// HA 返回 [{domain: "light", services: {turn_on: {...}, ...}}, ...]
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, &MCPError{Code: "InternalError", Message: err.Error()}
+	}
+
+	domainServices := map[string]interface{}{}
+	for _, entry := range raw {
+		domain, ok := entry["domain"].(string)
+		if !ok {
+			continue
+		}
+		domainServices[domain] = entry["services"]
+	}
+
+	return map[string]interface{}{
+		"content": []interface{}{
+			map[string]interface{}{
+				"type": "text",
+				"text": toPrettyJSON(domainServices),
+			},
+		},
+	}, nil
+}
+
+func (s *HomeAssistantServer) subscribeEvents(sessionID string, args map[string]interface{}) (interface{}, *MCPError) {
+	inst, mcpErr := s.resolveInstance(args)
+	if mcpErr != nil {
+		return nil, mcpErr
+	}
+	hub, ok := s.wsHubs[inst.Name]
+	if !ok {
+		return nil, &MCPError{Code: "InternalError", Message: "事件订阅子系统未启动"}
+	}
+
+	eventType, _ := args["event_type"].(string)
+	entityGlob, _ := args["entity_id_glob"].(string)
+
+	id := hub.Subscribe(eventType, entityGlob)
+
+	s.subOwnerMu.Lock()
+	s.subOwner[id] = subOwnerEntry{sessionID: sessionID, instance: inst.Name}
+	s.subOwnerMu.Unlock()
+
+	return map[string]interface{}{
+		"content": []interface{}{
+			map[string]interface{}{
+				"type": "text",
+				"text": fmt.Sprintf("已创建订阅 %s", id),
+			},
+		},
+		"subscription_id": id,
+	}, nil
+}
+
+func (s *HomeAssistantServer) unsubscribeEvents(sessionID string, args map[string]interface{}) (interface{}, *MCPError) {
+	id, ok := args["subscription_id"].(string)
+	if !ok || id == "" {
+		return nil, &MCPError{Code: "InvalidParams", Message: "subscription_id 是必需的"}
+	}
+
+	s.subOwnerMu.RLock()
+	entry, ok := s.subOwner[id]
+	s.subOwnerMu.RUnlock()
+	if !ok {
+		return nil, &MCPError{Code: "InvalidParams", Message: fmt.Sprintf("未知的订阅 %s", id)}
+	}
+
+	hub, ok := s.wsHubs[entry.instance]
+	if !ok || !hub.Unsubscribe(id) {
+		return nil, &MCPError{Code: "InvalidParams", Message: fmt.Sprintf("未知的订阅 %s", id)}
+	}
+
+	s.subOwnerMu.Lock()
+	delete(s.subOwner, id)
+	s.subOwnerMu.Unlock()
+
+	return map[string]interface{}{
+		"content": []interface{}{
+			map[string]interface{}{
+				"type": "text",
+				"text": fmt.Sprintf("已取消订阅 %s", id),
+			},
+		},
+	}, nil
+}
+
+func (s *HomeAssistantServer) cacheStats(args map[string]interface{}) (interface{}, *MCPError) {
+	return map[string]interface{}{
+		"content": []interface{}{
+			map[string]interface{}{
+				"type": "text",
+				"text": toPrettyJSON(s.cache.Stats()),
+			},
+		},
+	}, nil
+}
+
 // 辅助函数：将任意接口格式化为 JSON 字符串
 func toPrettyJSON(v interface{}) string {
 	bytes, err := json.MarshalIndent(v, "", "  ")
@@ -338,12 +733,12 @@ func toPrettyJSON(v interface{}) string {
 	return string(bytes)
 }
 
-func (s *HomeAssistantServer) handleRequest(req MCPRequest) MCPResponse {
+func (s *HomeAssistantServer) handleRequest(sessionID string, req MCPRequest) MCPResponse {
 	switch req.Method {
 	case "list_tools":
 		return s.handleListTools()
 	case "call_tool":
-		return s.handleCallTool(req.Params)
+		return s.handleCallTool(sessionID, req.Params)
 	default:
 		return MCPResponse{
 			Type: "error",
@@ -364,7 +759,7 @@ func (s *HomeAssistantServer) handleListTools() MCPResponse {
 	}
 }
 
-func (s *HomeAssistantServer) handleCallTool(params json.RawMessage) MCPResponse {
+func (s *HomeAssistantServer) handleCallTool(sessionID string, params json.RawMessage) MCPResponse {
 	// 定义参数结构
 	var callParams struct {
 		Name      string                 `json:"name"`
@@ -380,7 +775,26 @@ func (s *HomeAssistantServer) handleCallTool(params json.RawMessage) MCPResponse
 		}
 	}
 
+	if s.policy != nil {
+		decision, token, policyErr := s.policy.Evaluate(callParams.Name, callParams.Arguments)
+		switch decision {
+		case DecisionDeny:
+			s.policy.Audit(callParams.Name, callParams.Arguments, "denied", 0, "")
+			return MCPResponse{Type: "error", Error: policyErr}
+		case DecisionNeedsConfirmation:
+			s.policy.Audit(callParams.Name, callParams.Arguments, "confirmation_required", 0, "")
+			return MCPResponse{
+				Type: "confirmation_required",
+				Content: map[string]interface{}{
+					"confirm_token": token,
+					"message":       fmt.Sprintf("%s 需要二次确认，请携带 confirm_token 重新调用该工具", callParams.Name),
+				},
+			}
+		}
+	}
+
 	// 根据工具名称调用相应方法
+	start := time.Now()
 	var result interface{}
 	var mcpErr *MCPError
 
@@ -393,6 +807,16 @@ func (s *HomeAssistantServer) handleCallTool(params json.RawMessage) MCPResponse
 		result, mcpErr = s.triggerAutomation(callParams.Arguments)
 	case "list_entities":
 		result, mcpErr = s.listEntities(callParams.Arguments)
+	case "call_service":
+		result, mcpErr = s.callService(callParams.Arguments)
+	case "list_services":
+		result, mcpErr = s.listServices(callParams.Arguments)
+	case "subscribe_events":
+		result, mcpErr = s.subscribeEvents(sessionID, callParams.Arguments)
+	case "unsubscribe_events":
+		result, mcpErr = s.unsubscribeEvents(sessionID, callParams.Arguments)
+	case "cache_stats":
+		result, mcpErr = s.cacheStats(callParams.Arguments)
 	default:
 		mcpErr = &MCPError{
 			Code:    "MethodNotFound",
@@ -400,6 +824,16 @@ func (s *HomeAssistantServer) handleCallTool(params json.RawMessage) MCPResponse
 		}
 	}
 
+	if s.policy != nil {
+		decision := "allowed"
+		haStatus := "ok"
+		if mcpErr != nil {
+			decision = "error"
+			haStatus = mcpErr.Message
+		}
+		s.policy.Audit(callParams.Name, callParams.Arguments, decision, time.Since(start), haStatus)
+	}
+
 	if mcpErr != nil {
 		return MCPResponse{
 			Type:  "error",
@@ -413,18 +847,69 @@ func (s *HomeAssistantServer) handleCallTool(params json.RawMessage) MCPResponse
 	}
 }
 
-func (s *HomeAssistantServer) sendResponse(resp MCPResponse) {
-	bytes, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("响应序列化错误: %v\n", err)
-		return
+// sendNotification 把事件订阅子系统推送的事件包装成 MCP notification，
+// 并路由给拥有该订阅的会话（stdio 下只有一个隐式会话）。
+func (s *HomeAssistantServer) sendNotification(subscriptionID string, event interface{}) {
+	s.subOwnerMu.RLock()
+	entry, ok := s.subOwner[subscriptionID]
+	s.subOwnerMu.RUnlock()
+	sessionID := stdioSessionID
+	if ok {
+		sessionID = entry.sessionID
+	}
+
+	if err := s.transport.Notify(sessionID, MCPResponse{
+		Type:           "notification",
+		SubscriptionID: subscriptionID,
+		Event:          event,
+	}); err != nil {
+		log.Printf("事件通知投递失败: %v\n", err)
 	}
-	fmt.Println(string(bytes))
 }
 
-func (s *HomeAssistantServer) Run() {
+// cleanupSession 释放某个断开连接的会话所持有的订阅，避免它们泄漏给其他客户端
+func (s *HomeAssistantServer) cleanupSession(sessionID string) {
+	s.subOwnerMu.Lock()
+	owned := make(map[string]string) // subscription_id -> instance
+	for subID, entry := range s.subOwner {
+		if entry.sessionID == sessionID {
+			owned[subID] = entry.instance
+		}
+	}
+	for subID := range owned {
+		delete(s.subOwner, subID)
+	}
+	s.subOwnerMu.Unlock()
+
+	for subID, instance := range owned {
+		if hub, ok := s.wsHubs[instance]; ok {
+			hub.Unsubscribe(subID)
+		}
+	}
+}
+
+// Run 驱动服务器的主循环：从 transport 收请求、分发、把响应发回去。
+// transport 决定了底层是 stdio 还是 HTTP+SSE。
+func (s *HomeAssistantServer) Run(transport Transport) {
 	// 初始化工具
 	s.InitializeTools()
+	s.transport = transport
+
+	// 为每个 HA 实例启动事件订阅子系统（websocket 长连接 + 自动重连）
+	s.wsHubs = make(map[string]*EventHub, len(s.Instances))
+	for name, inst := range s.Instances {
+		hub := NewEventHub(inst.BaseURL, inst.Token)
+		instanceName := name
+		hub.SetOnEvent(s.sendNotification)
+		hub.SetOnStateChanged(func(entityID string) { s.cache.InvalidateEntity(instanceName, entityID) })
+		go hub.Run()
+		s.wsHubs[name] = hub
+	}
+	defer func() {
+		for _, hub := range s.wsHubs {
+			hub.Close()
+		}
+	}()
 
 	// 设置信号监听
 	signal.Notify(s.ExitChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -436,47 +921,56 @@ func (s *HomeAssistantServer) Run() {
 		os.Exit(0)
 	}()
 
-	// 读取标准输入
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := scanner.Text()
-		var req MCPRequest
-		if err := json.Unmarshal([]byte(line), &req); err != nil {
-			resp := MCPResponse{
-				Type: "error",
-				Error: &MCPError{
-					Code:    "InvalidRequest",
-					Message: "请求解析错误",
-				},
+	for {
+		req, sessionID, err := transport.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return
 			}
-			s.sendResponse(resp)
-			continue
+			if err == errInvalidRequestBody {
+				_ = transport.Send(sessionID, MCPResponse{
+					Type: "error",
+					Error: &MCPError{
+						Code:    "InvalidRequest",
+						Message: "请求解析错误",
+					},
+				})
+				continue
+			}
+			log.Printf("读取请求错误: %v\n", err)
+			return
 		}
 
-		resp := s.handleRequest(req)
-		s.sendResponse(resp)
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("读取标准输入错误: %v\n", err)
+		resp := s.handleRequest(sessionID, req)
+		if err := transport.Send(sessionID, resp); err != nil {
+			log.Printf("响应发送失败: %v\n", err)
+		}
 	}
 }
 
 func main() {
-	// 读取环境变量
-	haURL := os.Getenv(HA_URL_KEY)
-	if haURL == "" {
-		haURL = DEFAULT_HA_URL
-	}
-	haToken := os.Getenv(HA_TOKEN_KEY)
-	if haToken == "" {
-		log.Fatal("环境变量 HA_TOKEN 是必需的")
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
 	}
 
-	// 创建服务器实例
-	server := NewHomeAssistantServer(haURL, haToken)
-
-	// 运行服务器
-	log.Println("Home Assistant MCP 服务器正在通过 stdio 运行")
-	server.Run()
+	server, err := NewHomeAssistantServer(cfg)
+	if err != nil {
+		log.Fatalf("初始化服务器失败: %v", err)
+	}
+
+	switch cfg.Transport {
+	case "stdio":
+		log.Println("Home Assistant MCP 服务器正在通过 stdio 运行")
+		server.Run(NewStdioTransport())
+	case "http":
+		log.Println("Home Assistant MCP 服务器正在通过 HTTP+SSE 运行")
+		httpTransport := NewHTTPTransport(cfg.Listen, server.cleanupSession)
+		go server.Run(httpTransport)
+		if err := httpTransport.ListenAndServe(); err != nil {
+			log.Fatalf("HTTP 服务器退出: %v", err)
+		}
+	default:
+		log.Fatalf("未知的 --transport: %s（可选 stdio、http）", cfg.Transport)
+	}
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PolicyConfig 对应 TOML 配置文件中的 [policy] 块
+type PolicyConfig struct {
+	AllowTools          []string `toml:"allow_tools"`
+	DenyTools           []string `toml:"deny_tools"`
+	AllowEntities       []string `toml:"allow_entities"`
+	DenyEntities        []string `toml:"deny_entities"`
+	RequireConfirmation []string `toml:"require_confirmation"`
+	AuditLog            string   `toml:"audit_log"` // "stderr"（默认）、文件路径，或 "syslog"
+}
+
+// confirmationTTL 是一个 confirm_token 的有效期，过期后必须重新发起确认
+const confirmationTTL = 5 * time.Minute
+
+type pendingConfirmation struct {
+	tool      string
+	argsHash  string
+	createdAt time.Time
+}
+
+// Decision 是 Policy.Evaluate 的裁决结果
+type Decision int
+
+const (
+	DecisionAllow Decision = iota
+	DecisionDeny
+	DecisionNeedsConfirmation
+)
+
+// Policy 在工具实际执行前做准入检查（工具级/实体级的 allow/deny glob、
+// 二次确认），并把每次调用写成结构化审计日志。
+type Policy struct {
+	cfg PolicyConfig
+
+	auditMu sync.Mutex
+	audit   io.Writer
+
+	confirmMu sync.Mutex
+	pending   map[string]pendingConfirmation
+}
+
+// NewPolicy 按 cfg.AuditLog 打开审计日志 sink："stderr"（默认）、文件路径或 "syslog"
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	var sink io.Writer
+	switch cfg.AuditLog {
+	case "", "stderr":
+		sink = os.Stderr
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO, "ha-mcp")
+		if err != nil {
+			return nil, fmt.Errorf("连接 syslog 失败: %w", err)
+		}
+		sink = w
+	default:
+		f, err := os.OpenFile(cfg.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("打开审计日志文件 %s 失败: %w", cfg.AuditLog, err)
+		}
+		sink = f
+	}
+
+	return &Policy{cfg: cfg, audit: sink, pending: make(map[string]pendingConfirmation)}, nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// appendEntityIDs 把 v 中包含的 entity_id 追加进 ids：HA 既接受单个字符串，
+// 也接受字符串数组（如 target.entity_id: ["a", "b"]），两种形态都要覆盖
+func appendEntityIDs(ids []string, v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		if val != "" {
+			ids = append(ids, val)
+		}
+	case []interface{}:
+		for _, item := range val {
+			if s, ok := item.(string); ok && s != "" {
+				ids = append(ids, s)
+			}
+		}
+	}
+	return ids
+}
+
+// extractEntityIDs 从常见的参数形态中取出所有涉及的 entity_id，用于按实体做
+// allow/deny 过滤；不仅要看顶层 entity_id/automation_id/target.entity_id，call_service 还会
+// 把实体塞进 service_data.entity_id，否则可以绕过过滤直接操作被 deny 的实体。
+// 不涉及具体实体的工具（如 list_entities）返回空切片，表示跳过实体检查
+func extractEntityIDs(args map[string]interface{}) []string {
+	var ids []string
+	ids = appendEntityIDs(ids, args["entity_id"])
+	ids = appendEntityIDs(ids, args["automation_id"])
+	if target, ok := args["target"].(map[string]interface{}); ok {
+		ids = appendEntityIDs(ids, target["entity_id"])
+	}
+	if serviceData, ok := args["service_data"].(map[string]interface{}); ok {
+		ids = appendEntityIDs(ids, serviceData["entity_id"])
+	}
+	return ids
+}
+
+// hasField 判断 m[key] 是否存在且非空（空字符串、空数组视为未设置）
+func hasField(m map[string]interface{}, key string) bool {
+	switch v := m[key].(type) {
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case nil:
+		return false
+	default:
+		return true
+	}
+}
+
+// hasUnresolvableTarget 报告这次调用是否按 area_id/device_id 下发：HA 会把它们
+// 在服务端展开成该区域/设备下的全部实体，策略层这里看不到具体是哪些实体，因此
+// 无法对其做 allow_entities/deny_entities 过滤
+func hasUnresolvableTarget(args map[string]interface{}) bool {
+	if hasField(args, "area_id") || hasField(args, "device_id") {
+		return true
+	}
+	if target, ok := args["target"].(map[string]interface{}); ok {
+		if hasField(target, "area_id") || hasField(target, "device_id") {
+			return true
+		}
+	}
+	if serviceData, ok := args["service_data"].(map[string]interface{}); ok {
+		if hasField(serviceData, "area_id") || hasField(serviceData, "device_id") {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate 判断一次工具调用是否放行。返回 DecisionNeedsConfirmation 时附带的
+// token 应随 "confirm_token" 参数回传，再次调用同一工具即可放行。
+func (p *Policy) Evaluate(tool string, args map[string]interface{}) (Decision, string, *MCPError) {
+	if len(p.cfg.AllowTools) > 0 && !matchesAny(p.cfg.AllowTools, tool) {
+		return DecisionDeny, "", &MCPError{Code: "Forbidden", Message: fmt.Sprintf("工具 %s 不在 allow_tools 白名单内", tool)}
+	}
+	if matchesAny(p.cfg.DenyTools, tool) {
+		return DecisionDeny, "", &MCPError{Code: "Forbidden", Message: fmt.Sprintf("工具 %s 被 deny_tools 禁止", tool)}
+	}
+
+	if len(p.cfg.AllowEntities) > 0 || len(p.cfg.DenyEntities) > 0 {
+		if hasUnresolvableTarget(args) {
+			return DecisionDeny, "", &MCPError{Code: "Forbidden", Message: "配置了 allow_entities/deny_entities 时不支持按 area_id/device_id 下发调用，请改用 entity_id"}
+		}
+		for _, entityID := range extractEntityIDs(args) {
+			if len(p.cfg.AllowEntities) > 0 && !matchesAny(p.cfg.AllowEntities, entityID) {
+				return DecisionDeny, "", &MCPError{Code: "Forbidden", Message: fmt.Sprintf("实体 %s 不在 allow_entities 白名单内", entityID)}
+			}
+			if matchesAny(p.cfg.DenyEntities, entityID) {
+				return DecisionDeny, "", &MCPError{Code: "Forbidden", Message: fmt.Sprintf("实体 %s 被 deny_entities 禁止", entityID)}
+			}
+		}
+	}
+
+	if matchesAny(p.cfg.RequireConfirmation, tool) {
+		if token, ok := args["confirm_token"].(string); ok && token != "" {
+			if p.consumeConfirmation(token, tool, args) {
+				return DecisionAllow, "", nil
+			}
+			return DecisionDeny, "", &MCPError{Code: "InvalidParams", Message: "confirm_token 无效或已过期"}
+		}
+		return DecisionNeedsConfirmation, p.issueConfirmation(tool, args), nil
+	}
+
+	return DecisionAllow, "", nil
+}
+
+// hashConfirmArgs 对除 confirm_token 外的参数做规范化哈希，使发起确认时的
+// token 与具体的调用参数（而不仅仅是工具名）绑定，防止用无害参数换到的 token
+// 被重放到同一工具的另一次、参数不同的调用上
+func hashConfirmArgs(args map[string]interface{}) string {
+	normalized := make(map[string]interface{}, len(args))
+	for k, v := range args {
+		if k == "confirm_token" {
+			continue
+		}
+		normalized[k] = v
+	}
+	b, err := json.Marshal(normalized)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *Policy) issueConfirmation(tool string, args map[string]interface{}) string {
+	token := strconv.FormatInt(rand.Int63(), 36)
+	p.confirmMu.Lock()
+	p.pending[token] = pendingConfirmation{tool: tool, argsHash: hashConfirmArgs(args), createdAt: time.Now()}
+	p.confirmMu.Unlock()
+	return token
+}
+
+func (p *Policy) consumeConfirmation(token, tool string, args map[string]interface{}) bool {
+	p.confirmMu.Lock()
+	defer p.confirmMu.Unlock()
+	entry, ok := p.pending[token]
+	delete(p.pending, token)
+	if !ok || entry.tool != tool || time.Since(entry.createdAt) > confirmationTTL {
+		return false
+	}
+	return entry.argsHash == hashConfirmArgs(args)
+}
+
+// auditEntry 是写入审计日志 sink 的一行结构化记录
+type auditEntry struct {
+	Time      string      `json:"time"`
+	Tool      string      `json:"tool"`
+	Args      interface{} `json:"args"`
+	EntityID  []string    `json:"entity_id,omitempty"`
+	Decision  string      `json:"decision"`
+	LatencyMS int64       `json:"latency_ms"`
+	HAStatus  string      `json:"ha_status,omitempty"`
+}
+
+// Audit 写一行审计日志，记录每次被接受或拒绝的调用
+func (p *Policy) Audit(tool string, args map[string]interface{}, decision string, latency time.Duration, haStatus string) {
+	entry := auditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Tool:      tool,
+		Args:      args,
+		EntityID:  extractEntityIDs(args),
+		Decision:  decision,
+		LatencyMS: latency.Milliseconds(),
+		HAStatus:  haStatus,
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	p.auditMu.Lock()
+	defer p.auditMu.Unlock()
+	fmt.Fprintln(p.audit, string(b))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// stdioSessionID 是 stdio 传输下唯一的（隐式）会话 ID
+const stdioSessionID = "stdio"
+
+// Transport 把 MCP 的请求/响应收发与具体的传输方式（stdio、HTTP+SSE...）解耦。
+// 每个请求都归属于一个会话（sessionID）：stdio 下只有一个固定会话，HTTP 下每个
+// SSE 连接都是独立的会话，使得事件订阅等服务端推送能精确投递给发起方。
+type Transport interface {
+	// Recv 阻塞直到下一个请求到达，返回请求与其所属的会话 ID；
+	// 传输关闭时返回 io.EOF。
+	Recv() (MCPRequest, string, error)
+	// Send 把某个请求的响应发送回其所属会话。
+	Send(sessionID string, resp MCPResponse) error
+	// Notify 推送一条服务端主动发起的消息（如事件订阅通知）给指定会话。
+	Notify(sessionID string, resp MCPResponse) error
+}
+
+// StdioTransport 是原有的单会话、逐行读写 stdio 实现
+type StdioTransport struct {
+	scanner *bufio.Scanner
+	mu      sync.Mutex
+}
+
+func NewStdioTransport() *StdioTransport {
+	return &StdioTransport{scanner: bufio.NewScanner(os.Stdin)}
+}
+
+func (t *StdioTransport) Recv() (MCPRequest, string, error) {
+	if !t.scanner.Scan() {
+		if err := t.scanner.Err(); err != nil {
+			return MCPRequest{}, stdioSessionID, err
+		}
+		return MCPRequest{}, stdioSessionID, io.EOF
+	}
+
+	var req MCPRequest
+	if err := json.Unmarshal(t.scanner.Bytes(), &req); err != nil {
+		return MCPRequest{}, stdioSessionID, errInvalidRequestBody
+	}
+	return req, stdioSessionID, nil
+}
+
+func (t *StdioTransport) Send(sessionID string, resp MCPResponse) error {
+	return t.write(resp)
+}
+
+func (t *StdioTransport) Notify(sessionID string, resp MCPResponse) error {
+	return t.write(resp)
+}
+
+func (t *StdioTransport) write(resp MCPResponse) error {
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Println(string(bytes))
+	return nil
+}
+
+// errInvalidRequestBody 由 Recv 在收到无法解析的请求体时返回；调用方应当回复
+// InvalidRequest 错误而不是终止连接。
+var errInvalidRequestBody = fmt.Errorf("请求解析错误")
+
+// httpSession 代表一个 GET /mcp/sse 长连接
+type httpSession struct {
+	id string
+	ch chan MCPResponse
+}
+
+const sseSessionBuffer = 64
+
+// HTTPTransport 实现 MCP 的 HTTP+SSE 传输：POST /mcp 提交请求，GET /mcp/sse
+// 以 SSE 推送该会话的响应与事件通知，使多个客户端可以共享同一个服务进程。
+type HTTPTransport struct {
+	listen string
+
+	mu       sync.Mutex
+	sessions map[string]*httpSession
+
+	incoming chan incomingRequest
+
+	// onDisconnect 在一个 SSE 会话断开时被调用，供上层清理该会话持有的订阅等状态
+	onDisconnect func(sessionID string)
+}
+
+type incomingRequest struct {
+	req       MCPRequest
+	sessionID string
+}
+
+func NewHTTPTransport(listen string, onDisconnect func(sessionID string)) *HTTPTransport {
+	return &HTTPTransport{
+		listen:       listen,
+		sessions:     make(map[string]*httpSession),
+		incoming:     make(chan incomingRequest),
+		onDisconnect: onDisconnect,
+	}
+}
+
+func (t *HTTPTransport) Recv() (MCPRequest, string, error) {
+	item, ok := <-t.incoming
+	if !ok {
+		return MCPRequest{}, "", io.EOF
+	}
+	return item.req, item.sessionID, nil
+}
+
+func (t *HTTPTransport) Send(sessionID string, resp MCPResponse) error {
+	return t.Notify(sessionID, resp)
+}
+
+func (t *HTTPTransport) Notify(sessionID string, resp MCPResponse) error {
+	t.mu.Lock()
+	sess, ok := t.sessions[sessionID]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("未知的会话: %s", sessionID)
+	}
+
+	select {
+	case sess.ch <- resp:
+	default:
+		// 慢消费者：丢弃最旧的一条通知，保证服务端不被阻塞
+		select {
+		case <-sess.ch:
+		default:
+		}
+		select {
+		case sess.ch <- resp:
+		default:
+		}
+	}
+	return nil
+}
+
+// ListenAndServe 启动 HTTP 服务器；阻塞直到出错
+func (t *HTTPTransport) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp/sse", t.handleSSE)
+	mux.HandleFunc("/mcp", t.handlePost)
+
+	log.Printf("Home Assistant MCP 服务器正在通过 HTTP+SSE 监听 %s", t.listen)
+	return http.ListenAndServe(t.listen, mux)
+}
+
+func (t *HTTPTransport) handleSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "此连接不支持流式响应", http.StatusInternalServerError)
+		return
+	}
+
+	sessionID := newSessionID()
+	sess := &httpSession{id: sessionID, ch: make(chan MCPResponse, sseSessionBuffer)}
+
+	t.mu.Lock()
+	t.sessions[sessionID] = sess
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.sessions, sessionID)
+		t.mu.Unlock()
+		if t.onDisconnect != nil {
+			t.onDisconnect(sessionID)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-MCP-Session", sessionID)
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", sessionID)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case resp := <-sess.ch:
+			b, err := json.Marshal(resp)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		}
+	}
+}
+
+func (t *HTTPTransport) handlePost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "仅支持 POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := r.Header.Get("X-MCP-Session")
+	if sessionID == "" {
+		sessionID = r.URL.Query().Get("session")
+	}
+	if sessionID == "" {
+		http.Error(w, "缺少会话 ID（X-MCP-Session 头或 session 查询参数）", http.StatusBadRequest)
+		return
+	}
+
+	t.mu.Lock()
+	_, ok := t.sessions[sessionID]
+	t.mu.Unlock()
+	if !ok {
+		http.Error(w, "未知的会话，请先建立 GET /mcp/sse 连接", http.StatusNotFound)
+		return
+	}
+
+	var req MCPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "请求解析错误", http.StatusBadRequest)
+		return
+	}
+
+	t.incoming <- incomingRequest{req: req, sessionID: sessionID}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func newSessionID() string {
+	return strconv.FormatInt(rand.Int63(), 36)
+}